@@ -0,0 +1,181 @@
+package canopus
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// Block-wise transfer (RFC 7959) support, so payloads larger than fit in a
+// single datagram (firmware/telemetry blobs, large .well-known/core
+// catalogs) can be split across multiple CoAP messages.
+
+const (
+	// DefaultBlockSize is the block size, in bytes, used when neither a
+	// server- nor route-level BlockSize override is set.
+	DefaultBlockSize = 1024
+
+	blockReassemblyTTL = 60 * time.Second
+)
+
+// BlockOption is the decoded form of a Block1/Block2 option value (RFC 7959
+// Section 2.2): a block sequence number, a more-blocks-follow flag, and a
+// block size exponent (SZX).
+type BlockOption struct {
+	Num  int
+	More bool
+	Szx  int
+}
+
+// sizeFromSzx returns the block size in bytes for an SZX exponent.
+func sizeFromSzx(szx int) int {
+	return 16 << uint(szx)
+}
+
+// szxFromSize returns the SZX exponent (0..6) for the largest block size
+// that is <= size, clamped to the RFC 7959 range of 16..1024 bytes.
+func szxFromSize(size int) int {
+	szx := 0
+	for szx < 6 && sizeFromSzx(szx+1) <= size {
+		szx++
+	}
+	return szx
+}
+
+// DecodeBlockOption parses a Block1/Block2 option value.
+func DecodeBlockOption(value []byte) BlockOption {
+	var v uint32
+	for _, b := range value {
+		v = v<<8 | uint32(b)
+	}
+
+	return BlockOption{
+		Num:  int(v >> 4),
+		More: v&0x08 != 0,
+		Szx:  int(v & 0x07),
+	}
+}
+
+// EncodeBlockOption serializes a BlockOption back to its RFC 7959 wire
+// representation, using the minimum number of bytes (1..3) needed.
+func EncodeBlockOption(b BlockOption) []byte {
+	v := uint32(b.Num)<<4 | uint32(b.Szx)&0x07
+	if b.More {
+		v |= 0x08
+	}
+
+	switch {
+	case v <= 0xFF:
+		return []byte{byte(v)}
+	case v <= 0xFFFF:
+		return []byte{byte(v >> 8), byte(v)}
+	default:
+		return []byte{byte(v >> 16), byte(v >> 8), byte(v)}
+	}
+}
+
+// sliceBlock2 returns the szx-sized block numbered num of payload, and
+// whether more blocks follow it.
+func sliceBlock2(payload []byte, num int, szx int) (block []byte, more bool) {
+	size := sizeFromSzx(szx)
+	start := num * size
+	if start >= len(payload) {
+		return []byte{}, false
+	}
+
+	end := start + size
+	if end >= len(payload) {
+		return payload[start:], false
+	}
+	return payload[start:end], true
+}
+
+// Block2Preferred adds a Block2 option to req expressing a preference for
+// blockSize-sized response blocks (16..1024), so that SendTo/Send opts into
+// a block-wise GET: a server that supports block-wise transfer will slice
+// its response accordingly starting from the first block.
+func Block2Preferred(req CoapRequest, blockSize int) {
+	req.GetMessage().AddOption(OPTION_BLOCK2, EncodeBlockOption(BlockOption{
+		Szx: szxFromSize(blockSize),
+	}))
+}
+
+// blockwiseKey identifies an in-progress block-wise transfer by requester
+// and token; RFC 7959 requires the same token across all blocks of a
+// transfer.
+func blockwiseKey(addr *net.UDPAddr, token string) string {
+	return addr.String() + "|" + token
+}
+
+type blockwiseBuffer struct {
+	payload  []byte
+	lastSeen time.Time
+}
+
+// blockwiseAssembler reassembles incoming Block1 request bodies, buffered
+// per (addr, token) so concurrent transfers don't collide.
+type blockwiseAssembler struct {
+	mu      sync.Mutex
+	buffers map[string]*blockwiseBuffer
+}
+
+func newBlockwiseAssembler() *blockwiseAssembler {
+	return &blockwiseAssembler{buffers: make(map[string]*blockwiseBuffer)}
+}
+
+// Append adds block's payload to the in-progress transfer identified by key.
+// It returns the complete payload once block.More is false; otherwise it
+// returns (nil, false). ack is the Block1 descriptor the caller should echo
+// back to the sender: normally just block itself, but when block leaves a
+// gap (arrives out of order) the block is dropped - rather than corrupting
+// what's been assembled so far - and ack instead reports the next block
+// actually expected, so a Continue response built from it tells the sender
+// exactly which block to retransmit rather than falsely confirming receipt
+// of the one that was dropped.
+func (a *blockwiseAssembler) Append(key string, block BlockOption, payload []byte) (full []byte, done bool, ack BlockOption) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	buf, ok := a.buffers[key]
+	if !ok {
+		buf = &blockwiseBuffer{}
+		a.buffers[key] = buf
+	}
+
+	offset := block.Num * sizeFromSzx(block.Szx)
+	switch {
+	case offset == len(buf.payload):
+		buf.payload = append(buf.payload, payload...)
+	case offset < len(buf.payload):
+		// Retransmit of an earlier block; overwrite instead of duplicating.
+		buf.payload = append(buf.payload[:offset], payload...)
+	default:
+		// Block arrived out of order; this assembler only supports
+		// in-order delivery, so drop it and report the block actually
+		// expected next instead of acknowledging the gap.
+		next := len(buf.payload) / sizeFromSzx(block.Szx)
+		return nil, false, BlockOption{Num: next, More: true, Szx: block.Szx}
+	}
+	buf.lastSeen = time.Now()
+
+	if block.More {
+		return nil, false, block
+	}
+
+	delete(a.buffers, key)
+	return buf.payload, true, block
+}
+
+// purgeExpired drops in-progress transfers that have been idle longer than
+// blockReassemblyTTL.
+func (a *blockwiseAssembler) purgeExpired() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	now := time.Now()
+	for key, buf := range a.buffers {
+		if now.Sub(buf.lastSeen) > blockReassemblyTTL {
+			delete(a.buffers, key)
+		}
+	}
+}
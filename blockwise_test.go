@@ -0,0 +1,221 @@
+package canopus
+
+import (
+	"bytes"
+	"testing"
+)
+
+const testSzx = 3 // 128-byte blocks
+
+func block(num int, more bool) BlockOption {
+	return BlockOption{Num: num, More: more, Szx: testSzx}
+}
+
+// TestBlockwiseAssemblerReassemblesInOrder exercises a multi-block transfer
+// (~10KB) arriving in order, checking the reassembled payload matches byte
+// for byte.
+func TestBlockwiseAssemblerReassemblesInOrder(t *testing.T) {
+	a := newBlockwiseAssembler()
+	key := "addr|token"
+
+	size := sizeFromSzx(testSzx)
+	payload := make([]byte, 10*1024)
+	for i := range payload {
+		payload[i] = byte(i)
+	}
+
+	var full []byte
+	var done bool
+	for num := 0; ; num++ {
+		start := num * size
+		if start >= len(payload) {
+			break
+		}
+		end := start + size
+		more := true
+		if end >= len(payload) {
+			end = len(payload)
+			more = false
+		}
+
+		var ack BlockOption
+		full, done, ack = a.Append(key, block(num, more), payload[start:end])
+		if ack.Num != num {
+			t.Fatalf("block %d: expected ack to echo the block sent, got %d", num, ack.Num)
+		}
+		if done != !more {
+			t.Fatalf("block %d: done=%v, want %v", num, done, !more)
+		}
+	}
+
+	if !done {
+		t.Fatal("expected the transfer to complete")
+	}
+	if !bytes.Equal(full, payload) {
+		t.Fatalf("reassembled payload does not match (got %d bytes, want %d)", len(full), len(payload))
+	}
+}
+
+// TestBlockwiseAssemblerGapDoesNotFalselyAck is the regression test for the
+// stall bug: when a block arrives leaving a gap, Append must not return an
+// ack that echoes the gap block's own number (the old behaviour, which made
+// handleMessage send a 2.31 Continue as if that block had been stored). It
+// must report the block actually still expected, so the sender knows to
+// retransmit from there instead of believing the transfer is progressing.
+func TestBlockwiseAssemblerGapDoesNotFalselyAck(t *testing.T) {
+	a := newBlockwiseAssembler()
+	key := "addr|token"
+	size := sizeFromSzx(testSzx)
+
+	block0 := bytes.Repeat([]byte{0xAA}, size)
+	full, done, ack := a.Append(key, block(0, true), block0)
+	if done || full != nil {
+		t.Fatalf("block 0: expected more blocks pending, got done=%v full=%v", done, full)
+	}
+	if ack.Num != 0 {
+		t.Fatalf("block 0: expected ack to echo block 0, got %d", ack.Num)
+	}
+
+	// Block 1 is lost; block 2 arrives next, leaving a gap.
+	block2 := bytes.Repeat([]byte{0xCC}, size)
+	full, done, ack = a.Append(key, block(2, true), block2)
+	if done || full != nil {
+		t.Fatalf("block 2 (gap): expected the gap block to be dropped, got done=%v full=%v", done, full)
+	}
+	if ack.Num != 1 {
+		t.Fatalf("block 2 (gap): expected ack to report block 1 as next expected, got %d", ack.Num)
+	}
+
+	// The sender, corrected by the ack, retransmits block 1 and then 2.
+	block1 := bytes.Repeat([]byte{0xBB}, size)
+	full, done, ack = a.Append(key, block(1, true), block1)
+	if done || full != nil || ack.Num != 1 {
+		t.Fatalf("block 1 (retransmit): got done=%v full=%v ack=%d", done, full, ack.Num)
+	}
+
+	full, done, ack = a.Append(key, block(2, false), block2)
+	if !done {
+		t.Fatal("expected the transfer to complete once the gap is filled")
+	}
+	want := append(append(append([]byte{}, block0...), block1...), block2...)
+	if !bytes.Equal(full, want) {
+		t.Fatalf("reassembled payload does not match after gap recovery")
+	}
+	if ack.Num != 2 {
+		t.Fatalf("final block: expected ack to echo block 2, got %d", ack.Num)
+	}
+}
+
+// TestBlockwiseAssemblerOverwritesRetransmittedBlock checks that a
+// retransmitted earlier block overwrites rather than duplicates.
+func TestBlockwiseAssemblerOverwritesRetransmittedBlock(t *testing.T) {
+	a := newBlockwiseAssembler()
+	key := "addr|token"
+	size := sizeFromSzx(testSzx)
+
+	block0a := bytes.Repeat([]byte{0x01}, size)
+	a.Append(key, block(0, true), block0a)
+
+	block0b := bytes.Repeat([]byte{0x02}, size)
+	full, done, _ := a.Append(key, block(0, false), block0b)
+	if !done {
+		t.Fatal("expected transfer to complete")
+	}
+	if !bytes.Equal(full, block0b) {
+		t.Fatalf("expected the retransmitted block to overwrite the original, got %v", full)
+	}
+}
+
+// TestSzxFromSize checks the SZX exponent chosen for a given requested block
+// size, including the boundary and clamping cases.
+func TestSzxFromSize(t *testing.T) {
+	cases := []struct {
+		size int
+		szx  int
+	}{
+		{size: 0, szx: 0},
+		{size: 16, szx: 0},
+		{size: 17, szx: 0}, // largest SZX whose size is <= 17 is still 16
+		{size: 32, szx: 1},
+		{size: DefaultBlockSize, szx: 6},
+		{size: DefaultBlockSize + 1, szx: 6}, // clamped to the RFC 7959 max of 1024
+	}
+
+	for _, c := range cases {
+		got := szxFromSize(c.size)
+		if got != c.szx {
+			t.Errorf("szxFromSize(%d) = %d, want %d", c.size, got, c.szx)
+		}
+		if c.size >= 16 && sizeFromSzx(got) > c.size {
+			t.Errorf("szxFromSize(%d) picked a block size larger than requested", c.size)
+		}
+	}
+}
+
+// TestSliceBlock2SlicesPayloadInOrder drives the Block2 (response-slicing)
+// direction across a payload that doesn't divide evenly into blocks,
+// checking every block's bytes and more-flag, and that reassembling them in
+// order reproduces the original payload.
+func TestSliceBlock2SlicesPayloadInOrder(t *testing.T) {
+	size := sizeFromSzx(testSzx)
+	payload := make([]byte, 10*size+37) // deliberately not a multiple of size
+	for i := range payload {
+		payload[i] = byte(i)
+	}
+
+	var got []byte
+	for num := 0; ; num++ {
+		block, more := sliceBlock2(payload, num, testSzx)
+		got = append(got, block...)
+		if !more {
+			break
+		}
+		if len(block) != size {
+			t.Fatalf("block %d: got %d bytes with more=true, want a full %d-byte block", num, len(block), size)
+		}
+	}
+
+	if !bytes.Equal(got, payload) {
+		t.Fatalf("reassembled payload does not match (got %d bytes, want %d)", len(got), len(payload))
+	}
+}
+
+// TestSliceBlock2OutOfRangeReturnsEmpty checks that requesting a block past
+// the end of the payload (e.g. a client retrying once it already has
+// everything) returns an empty, final block rather than panicking or
+// wrapping around.
+func TestSliceBlock2OutOfRangeReturnsEmpty(t *testing.T) {
+	payload := bytes.Repeat([]byte{0xFF}, sizeFromSzx(testSzx))
+
+	block, more := sliceBlock2(payload, 1, testSzx)
+	if len(block) != 0 || more {
+		t.Fatalf("out-of-range block: got len=%d more=%v, want len=0 more=false", len(block), more)
+	}
+}
+
+// TestSliceBlock2ServesLostIntermediateBlockAgain is the Block2-direction
+// counterpart of the Block1 gap regression test above: unlike Block1's
+// stateful Append, slicing a response is stateless, so when an intermediate
+// block is lost in transit and the client re-requests the same block number,
+// sliceBlock2 must hand back exactly the same bytes it did the first time -
+// the loss only costs that one block being re-requested, not the whole
+// transfer restarting or drifting.
+func TestSliceBlock2ServesLostIntermediateBlockAgain(t *testing.T) {
+	size := sizeFromSzx(testSzx)
+	payload := make([]byte, 5*size)
+	for i := range payload {
+		payload[i] = byte(i)
+	}
+
+	block1First, _ := sliceBlock2(payload, 1, testSzx)
+
+	// Block 1 is lost on the wire; the client never advances and instead
+	// re-requests block 1.
+	block1Retry, more := sliceBlock2(payload, 1, testSzx)
+	if !bytes.Equal(block1First, block1Retry) {
+		t.Fatal("expected re-requesting a lost block to return identical bytes")
+	}
+	if !more {
+		t.Fatal("expected more=true, block 1 of 5 isn't the last")
+	}
+}
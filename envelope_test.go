@@ -0,0 +1,42 @@
+package canopus
+
+import "testing"
+
+func TestNotifyEnvelopeRoundTrip(t *testing.T) {
+	cases := []struct {
+		confirm bool
+		value   string
+	}{
+		{true, "hello"},
+		{false, "hello"},
+		{true, ""},
+		{false, ""},
+	}
+
+	for _, c := range cases {
+		payload := encodeNotifyEnvelope(c.confirm, c.value)
+		value, confirm := decodeNotifyEnvelope(payload)
+		if value != c.value || confirm != c.confirm {
+			t.Errorf("encode/decode(%v, %q) round-tripped to (%v, %q)", c.confirm, c.value, confirm, value)
+		}
+	}
+}
+
+// TestNotifyEnvelopeIndependentOfSharedState checks that the confirm flag
+// travels with each publish rather than through any shared state: publishing
+// two different confirm values back-to-back must not let the second stomp
+// the first once both have already been encoded.
+func TestNotifyEnvelopeIndependentOfSharedState(t *testing.T) {
+	a := encodeNotifyEnvelope(true, "resource-a")
+	b := encodeNotifyEnvelope(false, "resource-b")
+
+	valueA, confirmA := decodeNotifyEnvelope(a)
+	valueB, confirmB := decodeNotifyEnvelope(b)
+
+	if valueA != "resource-a" || !confirmA {
+		t.Errorf("a decoded as (%q, %v), want (%q, true)", valueA, confirmA, "resource-a")
+	}
+	if valueB != "resource-b" || confirmB {
+		t.Errorf("b decoded as (%q, %v), want (%q, false)", valueB, confirmB, "resource-b")
+	}
+}
@@ -0,0 +1,41 @@
+// Package nats provides a canopus.NotificationBackend backed by NATS, the
+// first concrete adapter for the pluggable pub/sub bridge: each CoAP
+// resource maps to a NATS subject of the same name, so observation state
+// can be shared across multiple canopus instances behind a load balancer,
+// or driven by non-CoAP producers publishing directly to NATS.
+package nats
+
+import (
+	"github.com/MalteJ/canopus"
+	gnatsd "github.com/nats-io/nats.go"
+)
+
+// NewBackend connects to the NATS server at url and returns a
+// canopus.NotificationBackend backed by it.
+func NewBackend(url string) (canopus.NotificationBackend, error) {
+	conn, err := gnatsd.Connect(url)
+	if err != nil {
+		return nil, err
+	}
+
+	return &backend{conn: conn}, nil
+}
+
+type backend struct {
+	conn *gnatsd.Conn
+}
+
+func (b *backend) Subscribe(resource string, handler func(payload []byte)) (func(), error) {
+	sub, err := b.conn.Subscribe(resource, func(msg *gnatsd.Msg) {
+		handler(msg.Data)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return func() { sub.Unsubscribe() }, nil
+}
+
+func (b *backend) Publish(resource string, payload []byte) error {
+	return b.conn.Publish(resource, payload)
+}
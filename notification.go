@@ -0,0 +1,96 @@
+package canopus
+
+import "sync"
+
+// NotificationBackend lets CoapServer observations be driven by an external
+// pub/sub broker instead of only in-process NotifyChange calls, so multiple
+// canopus instances behind a load balancer can share observation state and
+// non-CoAP producers (e.g. a device gateway) can push observe notifications.
+type NotificationBackend interface {
+	// Subscribe registers handler to be invoked with the payload of every
+	// message published to resource. The returned unsub func removes the
+	// subscription; it is safe to call more than once.
+	Subscribe(resource string, handler func(payload []byte)) (unsub func(), err error)
+
+	// Publish sends payload to every current subscriber of resource.
+	Publish(resource string, payload []byte) error
+}
+
+// NewInMemoryBackend returns the default NotificationBackend: an in-process
+// broker that preserves canopus' historical behaviour of notifying observers
+// directly, with no external dependency.
+func NewInMemoryBackend() NotificationBackend {
+	return &inMemoryBackend{
+		subs: make(map[string][]*inMemorySub),
+	}
+}
+
+type inMemorySub struct {
+	id      uint64
+	handler func(payload []byte)
+}
+
+type inMemoryBackend struct {
+	mu     sync.RWMutex
+	subs   map[string][]*inMemorySub
+	nextID uint64
+}
+
+func (b *inMemoryBackend) Subscribe(resource string, handler func(payload []byte)) (func(), error) {
+	b.mu.Lock()
+	b.nextID++
+	sub := &inMemorySub{id: b.nextID, handler: handler}
+	b.subs[resource] = append(b.subs[resource], sub)
+	b.mu.Unlock()
+
+	return func() { b.unsubscribe(resource, sub.id) }, nil
+}
+
+func (b *inMemoryBackend) unsubscribe(resource string, id uint64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	subs := b.subs[resource]
+	for i, s := range subs {
+		if s.id == id {
+			b.subs[resource] = append(subs[:i], subs[i+1:]...)
+			break
+		}
+	}
+	if len(b.subs[resource]) == 0 {
+		delete(b.subs, resource)
+	}
+}
+
+func (b *inMemoryBackend) Publish(resource string, payload []byte) error {
+	b.mu.RLock()
+	subs := append([]*inMemorySub(nil), b.subs[resource]...)
+	b.mu.RUnlock()
+
+	for _, s := range subs {
+		s.handler(payload)
+	}
+	return nil
+}
+
+// encodeNotifyEnvelope prefixes value with its confirm flag, so the flag
+// travels with the publish itself across any NotificationBackend (including
+// an external one like nats.NewBackend) instead of living in shared server
+// state that concurrent NotifyChange calls on different resources could
+// stomp before the backend's subscriber callback gets around to reading it.
+func encodeNotifyEnvelope(confirm bool, value string) []byte {
+	b := make([]byte, 1+len(value))
+	if confirm {
+		b[0] = 1
+	}
+	copy(b[1:], value)
+	return b
+}
+
+// decodeNotifyEnvelope reverses encodeNotifyEnvelope.
+func decodeNotifyEnvelope(payload []byte) (value string, confirm bool) {
+	if len(payload) == 0 {
+		return "", false
+	}
+	return string(payload[1:]), payload[0] != 0
+}
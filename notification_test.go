@@ -0,0 +1,67 @@
+package canopus
+
+import (
+	"net"
+	"sync"
+	"testing"
+)
+
+// TestFanOutNotificationPerObserverRequest guards against the historical bug
+// where a single CoapRequest was built once and mutated in the fan-out loop
+// while each iteration's send ran on a goroutine: the goroutines raced with
+// later mutations, so a notification could be delivered with another
+// observer's token/payload. Each observer must see its own token.
+func TestFanOutNotificationPerObserverRequest(t *testing.T) {
+	origSend := fanOutSend
+	defer func() { fanOutSend = origSend }()
+
+	type sent struct {
+		addr  string
+		token string
+	}
+
+	var mu sync.Mutex
+	var got []sent
+	var wg sync.WaitGroup
+
+	fanOutSend = func(c *CoapServer, req CoapRequest, addr *net.UDPAddr) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			mu.Lock()
+			got = append(got, sent{addr: addr.String(), token: string(req.GetMessage().Token)})
+			mu.Unlock()
+		}()
+	}
+
+	s := NewServer(&net.UDPAddr{Port: 5683}, nil)
+
+	const resource = "/observe"
+	observers := []struct {
+		addr  *net.UDPAddr
+		token string
+	}{
+		{addr: &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 10001}, token: "tokA"},
+		{addr: &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 10002}, token: "tokB"},
+	}
+	for _, o := range observers {
+		s.addObservation(resource, o.token, o.addr)
+	}
+
+	s.fanOutNotification(resource, "hello", false)
+	wg.Wait()
+
+	if len(got) != len(observers) {
+		t.Fatalf("expected %d sends, got %d: %+v", len(observers), len(got), got)
+	}
+
+	byAddr := make(map[string]string, len(got))
+	for _, g := range got {
+		byAddr[g.addr] = g.token
+	}
+	for _, o := range observers {
+		if token := byAddr[o.addr.String()]; token != o.token {
+			t.Errorf("observer %s: expected token %q, got %q", o.addr, o.token, token)
+		}
+	}
+}
@@ -0,0 +1,159 @@
+package canopus
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// DefaultMaxAge is how long an observation is kept without being refreshed
+// by its client before it is considered stale, absent a per-route override.
+const DefaultMaxAge = 60 * time.Second
+
+// NewObservation registers a fresh observation, timestamped now so it won't
+// be immediately considered stale.
+func NewObservation(addr *net.UDPAddr, token string, resource string) *Observation {
+	return &Observation{
+		Addr:        addr,
+		Token:       token,
+		Resource:    resource,
+		NotifyCount: 0,
+		MaxAge:      DefaultMaxAge,
+		lastRefresh: time.Now(),
+	}
+}
+
+type Observation struct {
+	Addr        *net.UDPAddr
+	Token       string
+	Resource    string
+	NotifyCount int
+
+	// MaxAge is how long this observation is kept without being refreshed
+	// (i.e. the client re-registering with a fresh Observe=0 request)
+	// before NotifyChange drops it.
+	MaxAge time.Duration
+
+	lastRefresh time.Time
+}
+
+func (o *Observation) key() string {
+	return observationKey(o.Addr, o.Token)
+}
+
+func (o *Observation) expired(now time.Time) bool {
+	return now.Sub(o.lastRefresh) > o.MaxAge
+}
+
+func observationKey(addr *net.UDPAddr, token string) string {
+	return addr.String() + "|" + token
+}
+
+// observationStore is a concurrency-safe registry of observations, keyed by
+// resource and then by (remote address, token) so a single client can hold
+// independent observations on multiple resources at once. It also tracks the
+// backend unsub func for each resource with at least one observer, guarded by
+// the same mutex, so resource registration/expiry and the bookkeeping of
+// which resources have a live backend subscription can never race against
+// each other.
+type observationStore struct {
+	mu    sync.RWMutex
+	obs   map[string]map[string]*Observation // resource -> (addr|token) -> Observation
+	unsub map[string]func()                  // resource -> backend unsub func
+}
+
+func newObservationStore() *observationStore {
+	return &observationStore{
+		obs:   make(map[string]map[string]*Observation),
+		unsub: make(map[string]func()),
+	}
+}
+
+// SetUnsub records unsub as the backend subscription for resource.
+func (s *observationStore) SetUnsub(resource string, unsub func()) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.unsub[resource] = unsub
+}
+
+// TakeUnsub removes and returns the backend unsub func for resource, if one
+// is currently registered.
+func (s *observationStore) TakeUnsub(resource string) (unsub func(), ok bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	unsub, ok = s.unsub[resource]
+	if ok {
+		delete(s.unsub, resource)
+	}
+	return unsub, ok
+}
+
+// Add registers o, replacing (refreshing) any existing observation for the
+// same resource and (addr, token).
+func (s *observationStore) Add(o *Observation) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.obs[o.Resource] == nil {
+		s.obs[o.Resource] = make(map[string]*Observation)
+	}
+	s.obs[o.Resource][o.key()] = o
+}
+
+// Remove deregisters the observation on resource held by (addr, token), if
+// any.
+func (s *observationStore) Remove(resource string, addr *net.UDPAddr, token string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.obs[resource], observationKey(addr, token))
+	if len(s.obs[resource]) == 0 {
+		delete(s.obs, resource)
+	}
+}
+
+// Has reports whether (addr, token) currently observes resource.
+func (s *observationStore) Has(resource string, addr *net.UDPAddr, token string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	_, ok := s.obs[resource][observationKey(addr, token)]
+	return ok
+}
+
+// List returns the observations currently registered on resource, dropping
+// (and forgetting) any that have exceeded their MaxAge without being
+// refreshed. emptied reports whether resource had at least one observation
+// before this call and has none afterwards, so the caller can run the same
+// unsubscribe bookkeeping removeObservation would have run.
+func (s *observationStore) List(resource string) (list []*Observation, emptied bool) {
+	now := time.Now()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	hadAny := len(s.obs[resource]) > 0
+
+	list = make([]*Observation, 0, len(s.obs[resource]))
+	for key, o := range s.obs[resource] {
+		if o.expired(now) {
+			delete(s.obs[resource], key)
+			continue
+		}
+		list = append(list, o)
+	}
+	if len(s.obs[resource]) == 0 {
+		delete(s.obs, resource)
+	}
+	return list, hadAny && len(list) == 0
+}
+
+// Count returns how many observations are currently registered on resource.
+func (s *observationStore) Count(resource string) int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return len(s.obs[resource])
+}
@@ -0,0 +1,144 @@
+package canopus
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func testObsAddr(t *testing.T, port int) *net.UDPAddr {
+	t.Helper()
+	return &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: port}
+}
+
+func TestObservationStoreListDropsExpiredAndReportsEmptied(t *testing.T) {
+	s := newObservationStore()
+	addr := testObsAddr(t, 10001)
+
+	o := NewObservation(addr, "tok", "/res")
+	o.MaxAge = time.Millisecond
+	s.Add(o)
+
+	time.Sleep(5 * time.Millisecond)
+
+	list, emptied := s.List("/res")
+	if len(list) != 0 {
+		t.Fatalf("expected the expired observation to be dropped, got %d", len(list))
+	}
+	if !emptied {
+		t.Fatal("expected emptied=true when the last observation on a resource expires")
+	}
+	if s.Count("/res") != 0 {
+		t.Fatalf("expected Count to be 0 after expiry, got %d", s.Count("/res"))
+	}
+}
+
+func TestObservationStoreListNotEmptiedWhenSomeSurvive(t *testing.T) {
+	s := newObservationStore()
+
+	expired := NewObservation(testObsAddr(t, 10001), "tokA", "/res")
+	expired.MaxAge = time.Millisecond
+	s.Add(expired)
+
+	fresh := NewObservation(testObsAddr(t, 10002), "tokB", "/res")
+	s.Add(fresh)
+
+	time.Sleep(5 * time.Millisecond)
+
+	list, emptied := s.List("/res")
+	if len(list) != 1 {
+		t.Fatalf("expected 1 surviving observation, got %d", len(list))
+	}
+	if emptied {
+		t.Fatal("expected emptied=false when an observation survives")
+	}
+}
+
+func TestObservationStoreListEmptiedFalseWhenAlreadyEmpty(t *testing.T) {
+	s := newObservationStore()
+
+	_, emptied := s.List("/never-observed")
+	if emptied {
+		t.Fatal("expected emptied=false for a resource that never had observations")
+	}
+}
+
+// TestObservationStoreConcurrentAccess exercises Add/Remove/List/Has/Count
+// from many goroutines at once under the race detector, covering the
+// RFC 7641 cancel and MaxAge-expiry paths concurrently with new observe
+// registrations.
+func TestObservationStoreConcurrentAccess(t *testing.T) {
+	s := newObservationStore()
+	const resource = "/res"
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		i := i
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			addr := testObsAddr(t, 20000+i)
+			for j := 0; j < 50; j++ {
+				o := NewObservation(addr, "tok", resource)
+				o.MaxAge = time.Millisecond
+				s.Add(o)
+				s.Has(resource, addr, "tok")
+				s.Count(resource)
+				s.List(resource)
+				s.Remove(resource, addr, "tok")
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// TestObservationStoreSetTakeUnsub checks the bookkeeping CoapServer relies
+// on to retire a resource's backend subscription exactly once, whether the
+// last observer went away via an explicit cancel or via MaxAge expiry.
+func TestObservationStoreSetTakeUnsub(t *testing.T) {
+	s := newObservationStore()
+
+	if _, ok := s.TakeUnsub("/res"); ok {
+		t.Fatal("expected no unsub registered yet")
+	}
+
+	var called int
+	s.SetUnsub("/res", func() { called++ })
+
+	unsub, ok := s.TakeUnsub("/res")
+	if !ok {
+		t.Fatal("expected a registered unsub")
+	}
+	unsub()
+	if called != 1 {
+		t.Fatalf("expected unsub to run once, ran %d times", called)
+	}
+
+	if _, ok := s.TakeUnsub("/res"); ok {
+		t.Fatal("expected TakeUnsub to remove the entry so it can't be taken twice")
+	}
+}
+
+// TestObservationStoreConcurrentSetTakeUnsub exercises SetUnsub/TakeUnsub
+// from many goroutines at once under the race detector: resourceUnsub used
+// to be a bare map mutated with no lock, and handleMessage runs every inbound
+// message (observe registration or cancel) on its own goroutine, so this
+// mirrors two resources' observers registering/cancelling concurrently.
+func TestObservationStoreConcurrentSetTakeUnsub(t *testing.T) {
+	s := newObservationStore()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		resource := testObsAddr(t, 30000+i%2).String()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				s.SetUnsub(resource, func() {})
+				s.TakeUnsub(resource)
+			}
+		}()
+	}
+	wg.Wait()
+}
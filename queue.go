@@ -1,16 +1,61 @@
 package canopus
+
 import (
-	"time"
 	"container/heap"
+	"fmt"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
 )
 
+const (
+	// ACK_TIMEOUT is the RFC 7252 base CON retransmission timeout.
+	ACK_TIMEOUT = 2 * time.Second
+
+	// ACK_RANDOM_FACTOR widens the initial retransmission timeout to a value
+	// uniformly chosen in [ACK_TIMEOUT, ACK_TIMEOUT*ACK_RANDOM_FACTOR).
+	ACK_RANDOM_FACTOR = 1.5
+
+	// MAX_RETRANSMIT is the number of times a CON message is retransmitted
+	// before it is given up on and an OnTimeout event fires.
+	MAX_RETRANSMIT = 4
+
+	// retransmitTick is how often the queue checks for items due a retransmit.
+	retransmitTick = 200 * time.Millisecond
+)
+
+// Clock abstracts time.Now so tests can drive the retransmission queue with a
+// fake clock instead of wall-clock time.
+type Clock interface {
+	Now() time.Time
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+// ItemKey identifies a CON transaction by MessageID and remote address, the
+// same key an ACK/RST for that transaction will be matched against.
+func ItemKey(messageID uint16, addr *net.UDPAddr) string {
+	return fmt.Sprintf("%d|%s", messageID, addr.String())
+}
+
+// Item is a message pending (re)transmission or acknowledgement.
 type Item struct {
-	value    	*CoapRequest 	// The value of the item; arbitrary.
-	priority 	int    			// The priority of the item in the queue.
-								// The index is needed by update and is maintained by the heap.Interface methods.
-	index 		int 			// The index of the item in the heap.
-	retries 	int
-	ts 			*time.Time
+	key     string       // ItemKey of the CON transaction
+	req     CoapRequest  // The value of the item; the CON request/notification being retransmitted.
+	conn    CanopusConnection
+	addr    *net.UDPAddr
+
+	priority int // The priority of the item in the queue; derived from its next deadline.
+	index    int // The index of the item in the heap. Maintained by the heap.Interface methods.
+
+	retries int
+	timeout time.Duration // current retransmission backoff
+	ts      time.Time     // time the item was last (re)sent
 }
 
 type PriorityQueue []*Item
@@ -18,7 +63,8 @@ type PriorityQueue []*Item
 func (pq PriorityQueue) Len() int { return len(pq) }
 
 func (pq PriorityQueue) Less(i, j int) bool {
-	// We want Pop to give us the highest, not lowest, priority so we use greater than here.
+	// We want Pop to give us the item with the nearest deadline, so the item
+	// due soonest carries the highest priority.
 	return pq[i].priority > pq[j].priority
 }
 
@@ -39,83 +85,207 @@ func (pq *PriorityQueue) Pop() interface{} {
 	old := *pq
 	n := len(old)
 	item := old[n-1]
+	old[n-1] = nil
 	item.index = -1 // for safety
 	*pq = old[0 : n-1]
 	return item
 }
 
-// update modifies the priority and value of an Item in the queue.
-func (pq *PriorityQueue) update(item *Item, value string, priority int) {
-	item.value = value
-	item.priority = priority
-	heap.Fix(pq, item.index)
-}
-
 type Queue interface {
 	Start()
 	Stop()
 	Push(*Item)
-	Pop()
+	Pop() *Item
 	Clear()
-	Get(string) *Item
+	Get(key string) *Item
+	Remove(key string) *Item
 	Send() error
 }
 
-func NewDefaultQueue() Queue {
-	return &DefaultQueue{}
+// NewDefaultQueue returns the built-in Queue implementation, a CON
+// retransmission queue following RFC 7252: the initial timeout is chosen
+// uniformly in [ACK_TIMEOUT, ACK_TIMEOUT*ACK_RANDOM_FACTOR), doubling on
+// every retry up to MAX_RETRANSMIT attempts. events is used to fire
+// OnTimeout when an item exhausts its retries; it may be nil in tests that
+// don't care about the event.
+func NewDefaultQueue(events *CanopusEvents) Queue {
+	return NewDefaultQueueWithClock(events, systemClock{})
+}
+
+// NewDefaultQueueWithClock is like NewDefaultQueue but allows tests to inject
+// a fake Clock so retransmission spacing can be asserted deterministically.
+func NewDefaultQueueWithClock(events *CanopusEvents, clock Clock) *DefaultQueue {
+	pq := make(PriorityQueue, 0)
+	heap.Init(&pq)
+
+	return &DefaultQueue{
+		priorityQueue: &pq,
+		items:         make(map[string]*Item),
+		events:        events,
+		clock:         clock,
+	}
 }
 
 type DefaultQueue struct {
-	priorityQueue 	*PriorityQueue
+	mu            sync.Mutex
+	priorityQueue *PriorityQueue
+	items         map[string]*Item
+
+	events *CanopusEvents
+	clock  Clock
+
+	stop chan struct{}
 }
 
 func (q *DefaultQueue) Start() {
-	// start gofunc for sending
-	
+	q.mu.Lock()
+	if q.stop != nil {
+		q.mu.Unlock()
+		return
+	}
+	stop := make(chan struct{})
+	q.stop = stop
+	q.mu.Unlock()
+
+	go func() {
+		ticker := time.NewTicker(retransmitTick)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				q.Send()
+			case <-stop:
+				return
+			}
+		}
+	}()
 }
 
 func (q *DefaultQueue) Stop() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
 
+	if q.stop != nil {
+		close(q.stop)
+		q.stop = nil
+	}
 }
 
 func (q *DefaultQueue) Push(i *Item) {
-	q.priorityQueue.Push(i)
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	now := q.clock.Now()
+	i.ts = now
+	i.retries = 0
+	i.timeout = initialTimeout()
+	i.priority = deadlinePriority(now, i.timeout)
+
+	heap.Push(q.priorityQueue, i)
+	q.items[i.key] = i
 }
 
 func (q *DefaultQueue) Pop() *Item {
-	return q.priorityQueue.Pop()
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.priorityQueue.Len() == 0 {
+		return nil
+	}
+	item := heap.Pop(q.priorityQueue).(*Item)
+	delete(q.items, item.key)
+	return item
 }
 
 func (q *DefaultQueue) Clear() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
 
+	pq := make(PriorityQueue, 0)
+	heap.Init(&pq)
+	q.priorityQueue = &pq
+	q.items = make(map[string]*Item)
 }
 
-func (q *DefaultQueue) Get(id string) *Item {
-	return q.Get(id)
+func (q *DefaultQueue) Get(key string) *Item {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return q.items[key]
 }
 
+func (q *DefaultQueue) Remove(key string) *Item {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	item, ok := q.items[key]
+	if !ok {
+		return nil
+	}
+	delete(q.items, key)
+	heap.Remove(q.priorityQueue, item.index)
+	return item
+}
+
+// Send retransmits every item whose deadline has elapsed, doubling its
+// backoff and rescheduling it, or - once MAX_RETRANSMIT has been exceeded -
+// firing OnTimeout and dropping it from the queue.
 func (q *DefaultQueue) Send() error {
+	now := q.clock.Now()
+
+	q.mu.Lock()
+	due := make([]*Item, 0)
+	for q.priorityQueue.Len() > 0 {
+		next := (*q.priorityQueue)[0]
+		if next.ts.Add(next.timeout).After(now) {
+			break
+		}
+		item := heap.Pop(q.priorityQueue).(*Item)
+		delete(q.items, item.key)
+		due = append(due, item)
+	}
+	q.mu.Unlock()
+
+	for _, item := range due {
+		q.retransmit(item, now)
+	}
+
 	return nil
 }
 
+func (q *DefaultQueue) retransmit(item *Item, now time.Time) {
+	if item.retries >= MAX_RETRANSMIT {
+		q.mu.Lock()
+		delete(q.items, item.key)
+		q.mu.Unlock()
 
-/*
-	Operations
-		Push
-		Pop
-		Get
-		Clear
-		Send
+		if q.events != nil {
+			q.events.Timeout(item.req)
+		}
+		return
+	}
 
-	QueueItem
+	SendMessageTo(item.req.GetMessage(), item.conn, item.addr)
 
-	Periodically:
-		Try send items in queue via go routine
-		if fail,
-			if max_retransmit exceeded
-				fire OnTimeout event
-			else
-				increment max_retransmit
+	item.retries++
+	item.ts = now
+	item.timeout *= 2
+	item.priority = deadlinePriority(now, item.timeout)
 
+	q.mu.Lock()
+	heap.Push(q.priorityQueue, item)
+	q.items[item.key] = item
+	q.mu.Unlock()
+}
 
- */
\ No newline at end of file
+func initialTimeout() time.Duration {
+	factor := 1 + rand.Float64()*(ACK_RANDOM_FACTOR-1)
+	return time.Duration(float64(ACK_TIMEOUT) * factor)
+}
+
+func deadlinePriority(now time.Time, timeout time.Duration) int {
+	// Earlier deadlines must sort first, so negate the deadline: the item
+	// due soonest ends up with the highest (least negative) priority.
+	return -int(now.Add(timeout).UnixNano())
+}
@@ -0,0 +1,145 @@
+package canopus
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeClock is a manually-advanced Clock so retransmission timing can be
+// asserted deterministically instead of depending on wall-clock sleeps.
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time { return c.now }
+
+func (c *fakeClock) Advance(d time.Duration) { c.now = c.now.Add(d) }
+
+func testAddr(t *testing.T) *net.UDPAddr {
+	t.Helper()
+	addr, err := net.ResolveUDPAddr("udp", "127.0.0.1:5683")
+	if err != nil {
+		t.Fatalf("ResolveUDPAddr: %v", err)
+	}
+	return addr
+}
+
+// TestQueueSendRetransmitsAfterTimeout exercises the fake-clock-driven
+// backoff: an item isn't due before its timeout elapses, and is due (and
+// re-pushed with a doubled timeout) once it has.
+func TestQueueSendRetransmitsAfterTimeout(t *testing.T) {
+	clock := &fakeClock{now: time.Now()}
+	q := NewDefaultQueueWithClock(nil, clock)
+
+	addr := testAddr(t)
+	req := NewRequest(TYPE_CONFIRMABLE, COAPCODE_205_CONTENT, GenerateMessageId())
+	key := ItemKey(req.GetMessage().MessageId, addr)
+
+	q.Push(&Item{key: key, req: req, addr: addr})
+
+	if err := q.Send(); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	if item := q.Get(key); item == nil || item.retries != 0 {
+		t.Fatalf("item should not be due yet, got %+v", item)
+	}
+
+	clock.Advance(time.Duration(float64(ACK_TIMEOUT)*ACK_RANDOM_FACTOR) * 2)
+	if err := q.Send(); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+
+	item := q.Get(key)
+	if item == nil {
+		t.Fatal("item should still be queued for further retransmits")
+	}
+	if item.retries != 1 {
+		t.Fatalf("expected 1 retry, got %d", item.retries)
+	}
+}
+
+// TestQueueSendFiresTimeoutAfterMaxRetransmit checks that OnTimeout fires and
+// the item is dropped once MAX_RETRANSMIT has been exceeded.
+func TestQueueSendFiresTimeoutAfterMaxRetransmit(t *testing.T) {
+	clock := &fakeClock{now: time.Now()}
+	events := NewCanopusEvents()
+
+	var timedOut bool
+	events.OnTimeout(func(req CoapRequest) {
+		timedOut = true
+	})
+
+	q := NewDefaultQueueWithClock(events, clock)
+
+	addr := testAddr(t)
+	req := NewRequest(TYPE_CONFIRMABLE, COAPCODE_205_CONTENT, GenerateMessageId())
+	key := ItemKey(req.GetMessage().MessageId, addr)
+
+	q.Push(&Item{key: key, req: req, addr: addr})
+
+	for i := 0; i <= MAX_RETRANSMIT; i++ {
+		// The backoff doubles on every retry, so each step must cover the
+		// largest possible timeout at that retry.
+		clock.Advance(time.Duration(float64(ACK_TIMEOUT)*ACK_RANDOM_FACTOR) << uint(i))
+		if err := q.Send(); err != nil {
+			t.Fatalf("Send: %v", err)
+		}
+	}
+
+	if !timedOut {
+		t.Fatal("expected OnTimeout to fire after MAX_RETRANSMIT attempts")
+	}
+	if item := q.Get(key); item != nil {
+		t.Fatalf("expected item to be dropped from the queue, got %+v", item)
+	}
+}
+
+// TestQueueConcurrentSendAndRemoveDoesNotPanic guards against the race where
+// Send pops a due item off the heap on one goroutine while handleMessage
+// calls Remove for the matching ACK/RST on another. Send used to leave the
+// popped item in q.items (whose index the heap pop had set to -1), so a
+// Remove landing in that window called heap.Remove(q.priorityQueue, -1) and
+// panicked.
+func TestQueueConcurrentSendAndRemoveDoesNotPanic(t *testing.T) {
+	clock := &fakeClock{now: time.Now()}
+	q := NewDefaultQueueWithClock(nil, clock)
+	addr := testAddr(t)
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			req := NewRequest(TYPE_CONFIRMABLE, COAPCODE_205_CONTENT, GenerateMessageId())
+			key := ItemKey(req.GetMessage().MessageId, addr)
+			q.Push(&Item{key: key, req: req, addr: addr})
+			clock.Advance(time.Duration(float64(ACK_TIMEOUT)*ACK_RANDOM_FACTOR) * 2)
+			q.Send()
+			q.Remove(key)
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+				q.Send()
+			}
+		}
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+	close(stop)
+	wg.Wait()
+}
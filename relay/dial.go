@@ -0,0 +1,123 @@
+package relay
+
+import (
+	"net"
+	"time"
+)
+
+// keepAliveInterval is how often Dial refreshes its session with the relay
+// so the relay's TTL-based expiry doesn't forget it.
+const keepAliveInterval = 20 * time.Second
+
+// Dialer bridges a local UDP endpoint to a RelayServer session: datagrams
+// sent to Dialer.LocalAddr() are framed with the session ID and forwarded to
+// the relay, and datagrams the relay forwards back are unwrapped and
+// delivered to localAddr, so the thing sending to Dialer.LocalAddr() sees a
+// regular UDP peer and needs no knowledge of the relay framing.
+type Dialer struct {
+	sessionID [SessionIDLen]byte
+	token     [TokenLen]byte
+	relayAddr *net.UDPAddr
+	localAddr *net.UDPAddr
+
+	conn   *net.UDPConn
+	stopCh chan struct{}
+}
+
+// Dial opens a relay session identified by sessionID (as produced by
+// NewSessionID, and carrying both the session ID and its token) towards
+// relayAddr, forwarding anything the relay sends back to localAddr.
+func Dial(localAddr *net.UDPAddr, relayAddr *net.UDPAddr, sessionID string) (*Dialer, error) {
+	id, token, err := ParseSessionID(sessionID)
+	if err != nil {
+		return nil, err
+	}
+
+	// The bridge socket's LocalAddr() becomes CoapServer.remoteAddr (see
+	// DialViaRelay), so it must bind to a concrete, sendable address rather
+	// than localAddr.IP: CoAP servers are typically bound to a wildcard
+	// address (e.g. NewLocalServer, NewCoapServer(":5683")), which isn't a
+	// valid destination to send to.
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: loopbackFor(localAddr), Port: 0})
+	if err != nil {
+		return nil, err
+	}
+
+	d := &Dialer{
+		sessionID: id,
+		token:     token,
+		relayAddr: relayAddr,
+		localAddr: localAddr,
+		conn:      conn,
+		stopCh:    make(chan struct{}),
+	}
+
+	go d.serve()
+	go d.keepAlive()
+
+	return d, nil
+}
+
+// LocalAddr is the address outgoing datagrams must be sent to in order to be
+// relayed; the Dialer forwards them to the relay framed with its session ID.
+func (d *Dialer) LocalAddr() *net.UDPAddr {
+	return d.conn.LocalAddr().(*net.UDPAddr)
+}
+
+// Close tears down the dialer's socket and keep-alive goroutine.
+func (d *Dialer) Close() error {
+	close(d.stopCh)
+	return d.conn.Close()
+}
+
+func (d *Dialer) serve() {
+	buf := make([]byte, 65535)
+	for {
+		n, from, err := d.conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+
+		if isRelayAddr(from, d.relayAddr) {
+			frame, err := Decode(buf[:n])
+			if err != nil {
+				continue
+			}
+			d.conn.WriteToUDP(frame.Payload, d.localAddr)
+			continue
+		}
+
+		d.conn.WriteToUDP(Encode(d.sessionID, d.token, buf[:n]), d.relayAddr)
+	}
+}
+
+func (d *Dialer) keepAlive() {
+	ticker := time.NewTicker(keepAliveInterval)
+	defer ticker.Stop()
+
+	// Register with the relay immediately rather than waiting a full tick.
+	d.conn.WriteToUDP(Encode(d.sessionID, d.token, nil), d.relayAddr)
+
+	for {
+		select {
+		case <-ticker.C:
+			d.conn.WriteToUDP(Encode(d.sessionID, d.token, nil), d.relayAddr)
+		case <-d.stopCh:
+			return
+		}
+	}
+}
+
+func isRelayAddr(addr, relayAddr *net.UDPAddr) bool {
+	return addr.IP.Equal(relayAddr.IP) && addr.Port == relayAddr.Port
+}
+
+// loopbackFor returns the loopback address matching addr's IP family, so the
+// bridge socket binds to something a caller can actually send to rather than
+// inheriting a wildcard bind.
+func loopbackFor(addr *net.UDPAddr) net.IP {
+	if addr != nil && addr.IP != nil && addr.IP.To4() == nil {
+		return net.IPv6loopback
+	}
+	return net.IPv4(127, 0, 0, 1)
+}
@@ -0,0 +1,107 @@
+// Package relay implements a rendezvous relay for CoAP endpoints sitting
+// behind NAT: a RelayServer listens on a public UDP port, a constrained
+// client establishes a long-lived session through it, and any other CoAP
+// endpoint can reach that client by addressing datagrams to the relay with
+// the client's session ID rather than its (unreachable) UDP address.
+package relay
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+)
+
+const (
+	// frameVersion is the magic byte identifying this framing format. Bumped
+	// to 2 when the per-session token was added to the header.
+	frameVersion byte = 2
+
+	// SessionIDLen is the length in bytes of a relay session ID.
+	SessionIDLen = 8
+
+	// TokenLen is the length in bytes of a relay session token: a secret
+	// bound to a session ID on its first frame, and checked against on every
+	// frame after, so knowing/guessing a session ID alone isn't enough to
+	// inject into or hijack it.
+	TokenLen = 8
+
+	// credentialLen is the length of the combined session ID + token blob
+	// handed around as the opaque "session ID" string in Dial/DialViaRelay.
+	credentialLen = SessionIDLen + TokenLen
+
+	headerLen = 1 + SessionIDLen + TokenLen + 2 // version + session ID + token + uint16 payload length
+)
+
+// Frame is the wire format exchanged with a RelayServer: a 1-byte version,
+// an 8-byte session ID, an 8-byte session token, a 2-byte big-endian payload
+// length, and the payload itself. A zero-length payload is a keep-alive.
+type Frame struct {
+	SessionID [SessionIDLen]byte
+	Token     [TokenLen]byte
+	Payload   []byte
+}
+
+// Encode serializes payload, addressed to sessionID and authenticated with
+// token, into wire format.
+func Encode(sessionID [SessionIDLen]byte, token [TokenLen]byte, payload []byte) []byte {
+	buf := make([]byte, headerLen+len(payload))
+	buf[0] = frameVersion
+	copy(buf[1:1+SessionIDLen], sessionID[:])
+	copy(buf[1+SessionIDLen:1+SessionIDLen+TokenLen], token[:])
+	binary.BigEndian.PutUint16(buf[1+SessionIDLen+TokenLen:headerLen], uint16(len(payload)))
+	copy(buf[headerLen:], payload)
+	return buf
+}
+
+// Decode parses a Frame out of raw bytes read off the wire.
+func Decode(buf []byte) (Frame, error) {
+	if len(buf) < headerLen {
+		return Frame{}, fmt.Errorf("relay: frame too short (%d bytes)", len(buf))
+	}
+	if buf[0] != frameVersion {
+		return Frame{}, fmt.Errorf("relay: unsupported frame version %d", buf[0])
+	}
+
+	var sessionID [SessionIDLen]byte
+	copy(sessionID[:], buf[1:1+SessionIDLen])
+
+	var token [TokenLen]byte
+	copy(token[:], buf[1+SessionIDLen:1+SessionIDLen+TokenLen])
+
+	length := binary.BigEndian.Uint16(buf[1+SessionIDLen+TokenLen : headerLen])
+	if int(length) != len(buf)-headerLen {
+		return Frame{}, fmt.Errorf("relay: payload length mismatch (header says %d, got %d)", length, len(buf)-headerLen)
+	}
+
+	payload := make([]byte, length)
+	copy(payload, buf[headerLen:])
+
+	return Frame{SessionID: sessionID, Token: token, Payload: payload}, nil
+}
+
+// NewSessionID generates a random session ID and token, combined into a
+// single hex-encoded credential for use in relay.Dial/CoapServer.DialViaRelay.
+func NewSessionID() (string, error) {
+	var cred [credentialLen]byte
+	if _, err := rand.Read(cred[:]); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(cred[:]), nil
+}
+
+// ParseSessionID decodes a hex-encoded session ID/token credential as
+// produced by NewSessionID.
+func ParseSessionID(s string) (id [SessionIDLen]byte, token [TokenLen]byte, err error) {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		return id, token, fmt.Errorf("relay: invalid session id %q: %v", s, err)
+	}
+	if len(b) != credentialLen {
+		return id, token, fmt.Errorf("relay: session id %q must decode to %d bytes, got %d", s, credentialLen, len(b))
+	}
+
+	copy(id[:], b[:SessionIDLen])
+	copy(token[:], b[SessionIDLen:])
+	return id, token, nil
+}
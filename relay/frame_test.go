@@ -0,0 +1,83 @@
+package relay
+
+import "testing"
+
+func TestEncodeDecodeRoundTrip(t *testing.T) {
+	var id [SessionIDLen]byte
+	var token [TokenLen]byte
+	for i := range id {
+		id[i] = byte(i + 1)
+	}
+	for i := range token {
+		token[i] = byte(i + 100)
+	}
+
+	wire := Encode(id, token, []byte("hello"))
+
+	frame, err := Decode(wire)
+	if err != nil {
+		t.Fatalf("Decode: %v", err)
+	}
+	if frame.SessionID != id {
+		t.Errorf("SessionID = %v, want %v", frame.SessionID, id)
+	}
+	if frame.Token != token {
+		t.Errorf("Token = %v, want %v", frame.Token, token)
+	}
+	if string(frame.Payload) != "hello" {
+		t.Errorf("Payload = %q, want %q", frame.Payload, "hello")
+	}
+}
+
+func TestDecodeRejectsTruncatedFrame(t *testing.T) {
+	if _, err := Decode([]byte{frameVersion, 1, 2, 3}); err == nil {
+		t.Fatal("expected error decoding a too-short frame")
+	}
+}
+
+func TestDecodeRejectsWrongVersion(t *testing.T) {
+	var id [SessionIDLen]byte
+	var token [TokenLen]byte
+	wire := Encode(id, token, nil)
+	wire[0] = frameVersion + 1
+
+	if _, err := Decode(wire); err == nil {
+		t.Fatal("expected error decoding a frame with an unsupported version")
+	}
+}
+
+func TestNewSessionIDParseSessionIDRoundTrip(t *testing.T) {
+	cred, err := NewSessionID()
+	if err != nil {
+		t.Fatalf("NewSessionID: %v", err)
+	}
+
+	id, token, err := ParseSessionID(cred)
+	if err != nil {
+		t.Fatalf("ParseSessionID: %v", err)
+	}
+
+	var zero [SessionIDLen]byte
+	var zeroToken [TokenLen]byte
+	if id == zero {
+		t.Error("expected a non-zero session ID")
+	}
+	if token == zeroToken {
+		t.Error("expected a non-zero token")
+	}
+
+	// Two credentials should not collide in practice.
+	cred2, err := NewSessionID()
+	if err != nil {
+		t.Fatalf("NewSessionID: %v", err)
+	}
+	if cred == cred2 {
+		t.Fatal("expected distinct credentials from NewSessionID")
+	}
+}
+
+func TestParseSessionIDRejectsWrongLength(t *testing.T) {
+	if _, _, err := ParseSessionID("ab"); err == nil {
+		t.Fatal("expected error for a too-short credential")
+	}
+}
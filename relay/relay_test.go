@@ -0,0 +1,153 @@
+package relay
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func mustResolve(t *testing.T, addr string) *net.UDPAddr {
+	t.Helper()
+	a, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		t.Fatalf("ResolveUDPAddr(%q): %v", addr, err)
+	}
+	return a
+}
+
+// TestRelayRoundTrip drives two Dialers through a RelayServer on the same
+// session and checks a datagram sent to one Dialer's LocalAddr() is
+// delivered to the other's localAddr.
+func TestRelayRoundTrip(t *testing.T) {
+	relayServer := NewRelayServer(mustResolve(t, "127.0.0.1:0"))
+	if err := relayServer.Start(); err != nil {
+		t.Fatalf("RelayServer.Start: %v", err)
+	}
+	defer relayServer.Stop()
+	relayAddr := relayServer.conn.LocalAddr().(*net.UDPAddr)
+
+	sessionID, err := NewSessionID()
+	if err != nil {
+		t.Fatalf("NewSessionID: %v", err)
+	}
+
+	aConn, err := net.ListenUDP("udp", mustResolve(t, "127.0.0.1:0"))
+	if err != nil {
+		t.Fatalf("ListenUDP (a): %v", err)
+	}
+	defer aConn.Close()
+
+	bConn, err := net.ListenUDP("udp", mustResolve(t, "127.0.0.1:0"))
+	if err != nil {
+		t.Fatalf("ListenUDP (b): %v", err)
+	}
+	defer bConn.Close()
+
+	dialerA, err := Dial(aConn.LocalAddr().(*net.UDPAddr), relayAddr, sessionID)
+	if err != nil {
+		t.Fatalf("Dial (a): %v", err)
+	}
+	defer dialerA.Close()
+
+	dialerB, err := Dial(bConn.LocalAddr().(*net.UDPAddr), relayAddr, sessionID)
+	if err != nil {
+		t.Fatalf("Dial (b): %v", err)
+	}
+	defer dialerB.Close()
+
+	// Give both sides time to register with the relay via their initial
+	// keep-alive frame before exchanging traffic.
+	time.Sleep(100 * time.Millisecond)
+
+	if _, err := aConn.WriteToUDP([]byte("ping"), dialerA.LocalAddr()); err != nil {
+		t.Fatalf("WriteToUDP: %v", err)
+	}
+
+	buf := make([]byte, 1024)
+	bConn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	n, _, err := bConn.ReadFromUDP(buf)
+	if err != nil {
+		t.Fatalf("b did not receive relayed datagram: %v", err)
+	}
+	if got := string(buf[:n]); got != "ping" {
+		t.Fatalf("got %q, want %q", got, "ping")
+	}
+}
+
+// TestRelayServerRejectsWrongToken checks that a frame presenting an
+// existing session ID with the wrong token is dropped rather than treated as
+// part of that session, preventing session hijack by a guessed/leaked ID.
+func TestRelayServerRejectsWrongToken(t *testing.T) {
+	relayServer := NewRelayServer(mustResolve(t, "127.0.0.1:0"))
+	if err := relayServer.Start(); err != nil {
+		t.Fatalf("RelayServer.Start: %v", err)
+	}
+	defer relayServer.Stop()
+	relayAddr := relayServer.conn.LocalAddr().(*net.UDPAddr)
+
+	var sessionID [SessionIDLen]byte
+	var token [TokenLen]byte
+	sessionID[0] = 1
+	token[0] = 2
+
+	var wrongToken [TokenLen]byte
+	wrongToken[0] = 3
+
+	aConn, err := net.ListenUDP("udp", mustResolve(t, "127.0.0.1:0"))
+	if err != nil {
+		t.Fatalf("ListenUDP (a): %v", err)
+	}
+	defer aConn.Close()
+
+	bConn, err := net.ListenUDP("udp", mustResolve(t, "127.0.0.1:0"))
+	if err != nil {
+		t.Fatalf("ListenUDP (b): %v", err)
+	}
+	defer bConn.Close()
+
+	// a registers the session with the real token.
+	if _, err := aConn.WriteToUDP(Encode(sessionID, token, nil), relayAddr); err != nil {
+		t.Fatalf("WriteToUDP: %v", err)
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	// b tries to join the same session ID with the wrong token and sends
+	// traffic; it must not be relayed to a.
+	if _, err := bConn.WriteToUDP(Encode(sessionID, wrongToken, []byte("hijack")), relayAddr); err != nil {
+		t.Fatalf("WriteToUDP: %v", err)
+	}
+
+	aConn.SetReadDeadline(time.Now().Add(300 * time.Millisecond))
+	buf := make([]byte, 1024)
+	if _, _, err := aConn.ReadFromUDP(buf); err == nil {
+		t.Fatal("expected no datagram to be relayed to a from a mismatched-token sender")
+	}
+}
+
+// TestDialBridgeBindsToLoopback checks the bridge socket binds to a concrete
+// loopback address (not a wildcard) even when given a wildcard localAddr, as
+// a CoAP server bound with NewLocalServer/NewCoapServer(":5683") would pass.
+func TestDialBridgeBindsToLoopback(t *testing.T) {
+	relayServer := NewRelayServer(mustResolve(t, "127.0.0.1:0"))
+	if err := relayServer.Start(); err != nil {
+		t.Fatalf("RelayServer.Start: %v", err)
+	}
+	defer relayServer.Stop()
+	relayAddr := relayServer.conn.LocalAddr().(*net.UDPAddr)
+
+	sessionID, err := NewSessionID()
+	if err != nil {
+		t.Fatalf("NewSessionID: %v", err)
+	}
+
+	wildcard := mustResolve(t, ":0")
+	dialer, err := Dial(wildcard, relayAddr, sessionID)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer dialer.Close()
+
+	if dialer.LocalAddr().IP.IsUnspecified() {
+		t.Fatalf("LocalAddr() IP is unspecified: %v", dialer.LocalAddr())
+	}
+}
@@ -0,0 +1,195 @@
+package relay
+
+import (
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// sessionTTL is how long a peer address is remembered for a session without
+// hearing from it again (via traffic or a keep-alive frame).
+const sessionTTL = 60 * time.Second
+
+const purgeTick = 10 * time.Second
+
+type peer struct {
+	addr     *net.UDPAddr
+	lastSeen time.Time
+}
+
+type session struct {
+	mu    sync.Mutex
+	token [TokenLen]byte
+	peers map[string]*peer
+}
+
+func newSession(token [TokenLen]byte) *session {
+	return &session{token: token, peers: make(map[string]*peer)}
+}
+
+func (s *session) touch(addr *net.UDPAddr, now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.peers[addr.String()] = &peer{addr: addr, lastSeen: now}
+}
+
+func (s *session) others(except *net.UDPAddr) []*net.UDPAddr {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	addrs := make([]*net.UDPAddr, 0, len(s.peers))
+	for k, p := range s.peers {
+		if k != except.String() {
+			addrs = append(addrs, p.addr)
+		}
+	}
+	return addrs
+}
+
+func (s *session) purge(now time.Time) (empty bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for k, p := range s.peers {
+		if now.Sub(p.lastSeen) > sessionTTL {
+			delete(s.peers, k)
+		}
+	}
+	return len(s.peers) == 0
+}
+
+// RelayServer is the public-facing rendezvous relay: it tracks, per session
+// ID, the last-seen UDP address of every peer using that session, and
+// forwards any datagram received under a session ID to that session's other
+// peer(s).
+type RelayServer struct {
+	addr *net.UDPAddr
+	conn *net.UDPConn
+
+	mu       sync.RWMutex
+	sessions map[[SessionIDLen]byte]*session
+
+	stopCh chan struct{}
+}
+
+// NewRelayServer returns a RelayServer that will listen on addr once
+// started.
+func NewRelayServer(addr *net.UDPAddr) *RelayServer {
+	return &RelayServer{
+		addr:     addr,
+		sessions: make(map[[SessionIDLen]byte]*session),
+	}
+}
+
+// Start begins listening for relayed traffic. It returns once the socket is
+// bound; serving happens on a background goroutine.
+func (r *RelayServer) Start() error {
+	conn, err := net.ListenUDP("udp", r.addr)
+	if err != nil {
+		return err
+	}
+
+	r.conn = conn
+	stop := make(chan struct{})
+	r.stopCh = stop
+
+	go r.purgeExpired(stop)
+	go r.serve()
+
+	return nil
+}
+
+// Addr returns the address the relay is listening on, useful for discovering
+// the actual port after Start() when addr was given with a ":0" port.
+func (r *RelayServer) Addr() *net.UDPAddr {
+	return r.conn.LocalAddr().(*net.UDPAddr)
+}
+
+// Stop closes the relay's listening socket and stops its background
+// goroutines.
+func (r *RelayServer) Stop() {
+	if r.stopCh != nil {
+		close(r.stopCh)
+		r.stopCh = nil
+	}
+	if r.conn != nil {
+		r.conn.Close()
+	}
+}
+
+func (r *RelayServer) serve() {
+	buf := make([]byte, 65535)
+	for {
+		n, addr, err := r.conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+
+		frame, err := Decode(buf[:n])
+		if err != nil {
+			log.Println("relay: dropping malformed frame from", addr, ":", err)
+			continue
+		}
+
+		sess, ok := r.sessionFor(frame.SessionID, frame.Token)
+		if !ok {
+			log.Println("relay: dropping frame from", addr, ": wrong token for session")
+			continue
+		}
+		sess.touch(addr, time.Now())
+
+		if len(frame.Payload) == 0 {
+			// Keep-alive only; touch above already refreshed the peer.
+			continue
+		}
+
+		for _, dest := range sess.others(addr) {
+			r.conn.WriteToUDP(Encode(frame.SessionID, frame.Token, frame.Payload), dest)
+		}
+	}
+}
+
+// sessionFor returns the session for id, binding it to token if this is the
+// session's first frame. ok is false if id already exists under a different
+// token, in which case the caller must not treat the frame as belonging to
+// that session - this is what stops a guessed/leaked session ID alone from
+// injecting into or hijacking an existing session.
+func (r *RelayServer) sessionFor(id [SessionIDLen]byte, token [TokenLen]byte) (sess *session, ok bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	sess, exists := r.sessions[id]
+	if !exists {
+		sess = newSession(token)
+		r.sessions[id] = sess
+		return sess, true
+	}
+	return sess, sess.token == token
+}
+
+// purgeExpired evicts expired sessions on purgeTick until stop is closed.
+// stop is passed in rather than read from r.stopCh on every tick because
+// Stop() nils out r.stopCh after closing it, which a concurrent read here
+// would race with (mirrors the stop-channel-as-local pattern DefaultQueue.Start
+// uses).
+func (r *RelayServer) purgeExpired(stop <-chan struct{}) {
+	ticker := time.NewTicker(purgeTick)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			now := time.Now()
+			r.mu.Lock()
+			for id, sess := range r.sessions {
+				if sess.purge(now) {
+					delete(r.sessions, id)
+				}
+			}
+			r.mu.Unlock()
+		case <-stop:
+			return
+		}
+	}
+}
@@ -6,6 +6,8 @@ import (
 	"net"
 	"strconv"
 	"time"
+
+	"github.com/MalteJ/canopus/relay"
 )
 
 func NewLocalServer() *CoapServer {
@@ -23,15 +25,56 @@ func NewCoapServer(local string) *CoapServer {
 	return NewServer(localAddr, nil)
 }
 
-func NewServer(localAddr *net.UDPAddr, remoteAddr *net.UDPAddr) *CoapServer {
-	return &CoapServer{
+func NewServer(localAddr *net.UDPAddr, remoteAddr *net.UDPAddr, opts ...ServerOption) *CoapServer {
+	events := NewCanopusEvents()
+
+	s := &CoapServer{
 		remoteAddr:            remoteAddr,
 		localAddr:             localAddr,
-		events:                NewCanopusEvents(),
-		observations:          make(map[string][]*Observation),
+		events:                events,
+		observations:          newObservationStore(),
 		fnHandleCoapCoapProxy: NullProxyHandler,
 		fnHandleCoapHttpProxy: NullProxyHandler,
-		queue: NewDefaultQueue(),
+		queue:                 NewDefaultQueue(events),
+		backend:               NewInMemoryBackend(),
+		BlockSize:             DefaultBlockSize,
+		blocks:                newBlockwiseAssembler(),
+	}
+
+	for _, opt := range opts {
+		opt(s)
+	}
+
+	return s
+}
+
+// ServerOption configures optional behaviour on a CoapServer at construction
+// time, e.g. NewServer(addr, nil, WithQueue(myQueue)).
+type ServerOption func(*CoapServer)
+
+// WithQueue plugs an alternative Queue implementation in place of the
+// default RFC 7252 retransmission queue.
+func WithQueue(q Queue) ServerOption {
+	return func(s *CoapServer) {
+		s.queue = q
+	}
+}
+
+// WithNotificationBackend plugs an alternative NotificationBackend in place
+// of the default in-memory one, e.g. nats.NewBackend(url) to share
+// observation state across multiple canopus instances behind a load
+// balancer.
+func WithNotificationBackend(backend NotificationBackend) ServerOption {
+	return func(s *CoapServer) {
+		s.backend = backend
+	}
+}
+
+// WithBlockSize overrides the server-wide default block-wise transfer size
+// (see CoapServer.BlockSize).
+func WithBlockSize(size int) ServerOption {
+	return func(s *CoapServer) {
+		s.BlockSize = size
 	}
 }
 
@@ -45,12 +88,22 @@ type CoapServer struct {
 	messageIds   map[uint16]time.Time
 	routes       []*Route
 	events       *CanopusEvents
-	observations map[string][]*Observation
+	observations *observationStore
+
+	backend NotificationBackend
 
 	fnHandleCoapHttpProxy ProxyHandler
 	fnHandleCoapCoapProxy ProxyHandler
 
 	queue Queue
+
+	relayDialer *relay.Dialer
+
+	// BlockSize is the default block-wise transfer (RFC 7959) size, in
+	// bytes, used for responses and requested blocks when a route doesn't
+	// set its own Route.BlockSize. Defaults to DefaultBlockSize.
+	BlockSize int
+	blocks    *blockwiseAssembler
 }
 
 func (s *CoapServer) Start() {
@@ -116,6 +169,7 @@ func (s *CoapServer) serveServer() {
 	s.events.Started(s)
 
 	s.handleMessageIdPurge()
+	s.handleBlockwisePurge()
 	s.queue.Start()
 
 	readBuf := make([]byte, BUF_SIZE)
@@ -133,9 +187,24 @@ func (s *CoapServer) serveServer() {
 }
 
 func (s *CoapServer) Stop() {
+	s.queue.Stop()
+	if s.relayDialer != nil {
+		s.relayDialer.Close()
+	}
 	s.localConn.Close()
 }
 
+func (s *CoapServer) handleBlockwisePurge() {
+	// Routine for clearing up block-wise reassembly buffers that have gone
+	// stale because the sender never completed the transfer.
+	ticker := time.NewTicker(blockReassemblyTTL)
+	go func() {
+		for range ticker.C {
+			s.blocks.purgeExpired()
+		}
+	}()
+}
+
 func (s *CoapServer) handleMessageIdPurge() {
 	// Routine for clearing up message IDs which has expired
 	ticker := time.NewTicker(MESSAGEID_PURGE_DURATION * time.Second)
@@ -159,149 +228,186 @@ func (s *CoapServer) handleMessage(msgBuf []byte, conn *net.UDPConn, addr *net.U
 	s.events.Message(msg, true)
 
 	if msg.MessageType == TYPE_ACKNOWLEDGEMENT {
-		if msg.GetOption(OPTION_OBSERVE) != nil {
+		// An ACK cancels its CON's retransmissions regardless of whether it
+		// also piggybacks the first Observe notification (RFC 7641 commonly
+		// delivers that notification on the ACK to the registering GET,
+		// which is the same CON a prior Send/SendTo pushed onto the queue).
+		s.queue.Remove(ItemKey(msg.MessageId, addr))
 
+		if msg.GetOption(OPTION_OBSERVE) != nil {
 			s.events.Notify(msg.GetUriPath(), msg.Payload, msg)
 			return
 		}
-	} else {
-		if msg.MessageType != TYPE_RESET {
-			// Unsupported Method
-			if msg.Code != GET && msg.Code != POST && msg.Code != PUT && msg.Code != DELETE {
-				resp := NotImplementedMessage(msg.MessageId, TYPE_ACKNOWLEDGEMENT)
-				resp.CloneOptions(msg, OPTION_URI_PATH, OPTION_CONTENT_FORMAT)
-
-				s.events.Message(resp, false)
-				SendMessageTo(resp, NewCanopusUDPConnection(conn), addr)
+
+		return
+	}
+
+	if msg.MessageType == TYPE_RESET {
+		// An RST for a CON message we sent also cancels its retransmissions.
+		s.queue.Remove(ItemKey(msg.MessageId, addr))
+		return
+	}
+
+	// Unsupported Method
+	if msg.Code != GET && msg.Code != POST && msg.Code != PUT && msg.Code != DELETE {
+		resp := NotImplementedMessage(msg.MessageId, TYPE_ACKNOWLEDGEMENT)
+		resp.CloneOptions(msg, OPTION_URI_PATH, OPTION_CONTENT_FORMAT)
+
+		s.events.Message(resp, false)
+		SendMessageTo(resp, NewCanopusUDPConnection(conn), addr)
+		return
+	}
+
+	if err != nil {
+		s.events.Error(err)
+		if err == ERR_UNKNOWN_CRITICAL_OPTION {
+			if msg.MessageType == TYPE_CONFIRMABLE {
+				SendMessageTo(BadOptionMessage(msg.MessageId, TYPE_ACKNOWLEDGEMENT), NewCanopusUDPConnection(conn), addr)
+				return
+			} else {
+				// Ignore silently
 				return
 			}
+		}
+	}
+
+	// Proxy
+	if IsProxyRequest(msg) {
+		if IsCoapUri(msg) {
+			s.fnHandleCoapCoapProxy(msg, conn, addr)
+		} else if IsHttpUri(msg.GetOption(OPTION_PROXY_URI).StringValue()) {
+			s.fnHandleCoapHttpProxy(msg, conn, addr)
+		} else {
+			// Unknown URI
+		}
+	} else {
+		route, attrs, err := MatchingRoute(msg.GetUriPath(), MethodString(msg.Code), msg.GetOptions(OPTION_CONTENT_FORMAT), s.routes)
+		if err != nil {
+			if err == ERR_NO_MATCHING_ROUTE {
+				ret := NotFoundMessage(msg.MessageId, TYPE_ACKNOWLEDGEMENT)
+				ret.CloneOptions(msg, OPTION_URI_PATH, OPTION_CONTENT_FORMAT)
+				ret.Token = msg.Token
+
+				s.events.Message(ret, false)
+				SendMessageTo(ret, NewCanopusUDPConnection(conn), addr)
 
-			if err != nil {
 				s.events.Error(err)
-				if err == ERR_UNKNOWN_CRITICAL_OPTION {
-					if msg.MessageType == TYPE_CONFIRMABLE {
-						SendMessageTo(BadOptionMessage(msg.MessageId, TYPE_ACKNOWLEDGEMENT), NewCanopusUDPConnection(conn), addr)
-						return
-					} else {
-						// Ignore silently
-						return
-					}
-				}
+				return
 			}
 
-			// Proxy
-			if IsProxyRequest(msg) {
-				if IsCoapUri(msg) {
-					s.fnHandleCoapCoapProxy(msg, conn, addr)
-				} else if IsHttpUri(msg.GetOption(OPTION_PROXY_URI).StringValue()) {
-					s.fnHandleCoapHttpProxy(msg, conn, addr)
-				} else {
-					// Unknown URI
-				}
-			} else {
-				route, attrs, err := MatchingRoute(msg.GetUriPath(), MethodString(msg.Code), msg.GetOptions(OPTION_CONTENT_FORMAT), s.routes)
-				if err != nil {
-					if err == ERR_NO_MATCHING_ROUTE {
-						ret := NotFoundMessage(msg.MessageId, TYPE_ACKNOWLEDGEMENT)
-						ret.CloneOptions(msg, OPTION_URI_PATH, OPTION_CONTENT_FORMAT)
-						ret.Token = msg.Token
-
-						s.events.Message(ret, false)
-						SendMessageTo(ret, NewCanopusUDPConnection(conn), addr)
-
-						s.events.Error(err)
-						return
-					}
-
-					if err == ERR_NO_MATCHING_METHOD {
-						ret := MethodNotAllowedMessage(msg.MessageId, TYPE_ACKNOWLEDGEMENT)
-						ret.CloneOptions(msg, OPTION_URI_PATH, OPTION_CONTENT_FORMAT)
+			if err == ERR_NO_MATCHING_METHOD {
+				ret := MethodNotAllowedMessage(msg.MessageId, TYPE_ACKNOWLEDGEMENT)
+				ret.CloneOptions(msg, OPTION_URI_PATH, OPTION_CONTENT_FORMAT)
 
-						s.events.Message(ret, false)
-						SendMessageTo(ret, NewCanopusUDPConnection(conn), addr)
+				s.events.Message(ret, false)
+				SendMessageTo(ret, NewCanopusUDPConnection(conn), addr)
 
-						s.events.Error(err)
-						return
-					}
+				s.events.Error(err)
+				return
+			}
 
-					if err == ERR_UNSUPPORTED_CONTENT_FORMAT {
-						ret := UnsupportedContentFormatMessage(msg.MessageId, TYPE_ACKNOWLEDGEMENT)
-						ret.CloneOptions(msg, OPTION_URI_PATH, OPTION_CONTENT_FORMAT)
+			if err == ERR_UNSUPPORTED_CONTENT_FORMAT {
+				ret := UnsupportedContentFormatMessage(msg.MessageId, TYPE_ACKNOWLEDGEMENT)
+				ret.CloneOptions(msg, OPTION_URI_PATH, OPTION_CONTENT_FORMAT)
 
-						s.events.Message(ret, false)
-						SendMessageTo(ret, NewCanopusUDPConnection(conn), addr)
+				s.events.Message(ret, false)
+				SendMessageTo(ret, NewCanopusUDPConnection(conn), addr)
 
-						s.events.Error(err)
-						return
-					}
-				}
+				s.events.Error(err)
+				return
+			}
+		}
 
-				// Duplicate Message ID Check
-				_, dupe := s.messageIds[msg.MessageId]
-				if dupe {
-					log.Println("Duplicate Message ID ", msg.MessageId)
-					if msg.MessageType == TYPE_CONFIRMABLE {
-						ret := EmptyMessage(msg.MessageId, TYPE_RESET)
-						ret.CloneOptions(msg, OPTION_URI_PATH, OPTION_CONTENT_FORMAT)
+		// Duplicate Message ID Check
+		_, dupe := s.messageIds[msg.MessageId]
+		if dupe {
+			log.Println("Duplicate Message ID ", msg.MessageId)
+			if msg.MessageType == TYPE_CONFIRMABLE {
+				ret := EmptyMessage(msg.MessageId, TYPE_RESET)
+				ret.CloneOptions(msg, OPTION_URI_PATH, OPTION_CONTENT_FORMAT)
 
-						s.events.Message(ret, false)
-						SendMessageTo(ret, NewCanopusUDPConnection(conn), addr)
-					}
-					return
-				}
+				s.events.Message(ret, false)
+				SendMessageTo(ret, NewCanopusUDPConnection(conn), addr)
+			}
+			return
+		}
 
-				if err == nil {
-					s.messageIds[msg.MessageId] = time.Now()
+		if err == nil {
+			s.messageIds[msg.MessageId] = time.Now()
 
-					// Auto acknowledge
-					if msg.MessageType == TYPE_CONFIRMABLE && route.AutoAck {
-						ack := NewMessageOfType(TYPE_ACKNOWLEDGEMENT, msg.MessageId)
+			// Auto acknowledge
+			if msg.MessageType == TYPE_CONFIRMABLE && route.AutoAck {
+				ack := NewMessageOfType(TYPE_ACKNOWLEDGEMENT, msg.MessageId)
 
-						s.events.Message(ack, false)
-						SendMessageTo(ack, NewCanopusUDPConnection(conn), addr)
-					}
+				s.events.Message(ack, false)
+				SendMessageTo(ack, NewCanopusUDPConnection(conn), addr)
+			}
 
-					req := NewClientRequestFromMessage(msg, attrs, conn, addr)
+			req := NewClientRequestFromMessage(msg, attrs, conn, addr)
 
-					if msg.MessageType == TYPE_CONFIRMABLE {
-						obsOpt := msg.GetOption(OPTION_OBSERVE)
-						if obsOpt != nil {
-							// TODO: if server doesn't allow observing, return error
+			if block1Opt := msg.GetOption(OPTION_BLOCK1); block1Opt != nil {
+				block := DecodeBlockOption(block1Opt.Value.([]byte))
+				key := blockwiseKey(addr, string(msg.Token))
 
-							if obsOpt.Value == nil {
-								// TODO: Check if observation has been registered, if yes, remove it (observation == cancel)
-								resource := msg.GetUriPath()
-								if s.hasObservation(resource, addr) {
-									// Remove observation of client
-									s.removeObservation(resource, addr)
+				full, done, ackBlock := s.blocks.Append(key, block, msg.Payload.GetBytes())
+				if !done {
+					cont := NewMessageOfType(TYPE_ACKNOWLEDGEMENT, msg.MessageId)
+					cont.Code = COAPCODE_231_CONTINUE
+					cont.Token = msg.Token
+					cont.AddOption(OPTION_BLOCK1, EncodeBlockOption(ackBlock))
 
-									// Observe Cancel Request & Fire OnObserveCancel Event
-									s.events.ObserveCancelled(resource, msg)
-								} else {
-									// Register observation of client
-									s.addObservation(msg.GetUriPath(), string(msg.Token), addr)
+					s.events.Message(cont, false)
+					SendMessageTo(cont, NewCanopusUDPConnection(conn), addr)
+					return
+				}
 
-									// Observe Request & Fire OnObserve Event
-									s.events.Observe(resource, msg)
-								}
+				req.GetMessage().Payload = NewBytesPayload(full)
+			}
 
-								req.GetMessage().AddOption(OPTION_OBSERVE, 1)
-							}
+			if msg.MessageType == TYPE_CONFIRMABLE {
+				obsOpt := msg.GetOption(OPTION_OBSERVE)
+				if obsOpt != nil {
+					// TODO: if server doesn't allow observing, return error
+
+					resource := msg.GetUriPath()
+					token := string(msg.Token)
+
+					switch {
+					case obsOpt.Value == nil:
+						// No explicit register/deregister value: fall back to
+						// toggling on whether this client already observes
+						// the resource, for backward compatibility.
+						if s.hasObservation(resource, addr, token) {
+							s.removeObservation(resource, addr, token)
+							s.events.ObserveCancelled(resource, msg)
+						} else {
+							s.addObservation(resource, token, addr)
+							s.events.Observe(resource, msg)
 						}
+					case obsOpt.IntValue() == 1:
+						// RFC 7641 deregister value.
+						s.removeObservation(resource, addr, token)
+						s.events.ObserveCancelled(resource, msg)
+					default:
+						// RFC 7641 register value (0), or any other value -
+						// register/refresh the observation.
+						s.addObservation(resource, token, addr)
+						s.events.Observe(resource, msg)
 					}
 
-					resp := route.Handler(req)
-					_, nilresponse := resp.(NilResponse)
-					if !nilresponse {
-						respMsg := resp.GetMessage()
+					req.GetMessage().AddOption(OPTION_OBSERVE, 1)
+				}
+			}
 
-						// TODO: Validate Message before sending (e.g missing messageId)
-						err := ValidateMessage(respMsg)
-						if err == nil {
-							s.events.Message(respMsg, false)
-							SendMessageTo(respMsg, NewCanopusUDPConnection(conn), addr)
-						}
-					}
+			resp := route.Handler(req)
+			_, nilresponse := resp.(NilResponse)
+			if !nilresponse {
+				respMsg := resp.GetMessage()
+
+				// TODO: Validate Message before sending (e.g missing messageId)
+				err := ValidateMessage(respMsg)
+				if err == nil {
+					s.sendBlockwise(respMsg, msg, route, conn, addr)
 				}
 			}
 		}
@@ -348,7 +454,11 @@ func (s *CoapServer) NewRoute(path string, method CoapCode, fn RouteHandler) *Ro
 
 func (c *CoapServer) Send(req CoapRequest) (CoapResponse, error) {
 	c.events.Message(req.GetMessage(), false)
-	response, err := SendMessageTo(req.GetMessage(), NewCanopusUDPConnection(c.localConn), c.remoteAddr)
+
+	conn := NewCanopusUDPConnection(c.localConn)
+	c.enqueueConfirmable(req, conn, c.remoteAddr)
+
+	response, err := SendMessageTo(req.GetMessage(), conn, c.remoteAddr)
 
 	if err != nil {
 		c.events.Error(err)
@@ -360,62 +470,173 @@ func (c *CoapServer) Send(req CoapRequest) (CoapResponse, error) {
 }
 
 func (c *CoapServer) SendTo(req CoapRequest, addr *net.UDPAddr) (CoapResponse, error) {
-	return SendMessageTo(req.GetMessage(), NewCanopusUDPConnection(c.localConn), addr)
+	conn := NewCanopusUDPConnection(c.localConn)
+	c.enqueueConfirmable(req, conn, addr)
+
+	return SendMessageTo(req.GetMessage(), conn, addr)
 }
 
+// enqueueConfirmable hands a CON message to the retransmission queue so it
+// is retried with RFC 7252 backoff until a matching ACK/RST arrives via
+// handleMessage, or it times out after MAX_RETRANSMIT attempts.
+func (c *CoapServer) enqueueConfirmable(req CoapRequest, conn CanopusConnection, addr *net.UDPAddr) {
+	msg := req.GetMessage()
+	if msg.MessageType != TYPE_CONFIRMABLE {
+		return
+	}
+
+	c.queue.Push(&Item{
+		key:  ItemKey(msg.MessageId, addr),
+		req:  req,
+		conn: conn,
+		addr: addr,
+	})
+}
+
+// NotifyChange publishes value on resource via the server's
+// NotificationBackend. With the default in-memory backend this fans the
+// notification out to every local observer immediately, reproducing
+// canopus' historical in-process behaviour; with an external backend (e.g.
+// nats.NewBackend) it also reaches observers registered on other canopus
+// instances sharing that broker. confirm is used as a fallback when no route
+// serves resource (see routeConfirmable); it travels with
+// the publish itself (encodeNotifyEnvelope) rather than through shared
+// server state, since concurrent NotifyChange calls on different resources
+// would otherwise stomp each other's confirm value before the backend's
+// async subscriber callback got around to reading it.
 func (c *CoapServer) NotifyChange(resource, value string, confirm bool) {
-	t := c.observations[resource]
+	c.backend.Publish(resource, encodeNotifyEnvelope(confirm, value))
+}
 
-	if t != nil {
-		var req CoapRequest
+// fanOutSend delivers a single observer's notification; overridden in tests
+// to observe the exact request built for each observer without going over a
+// real socket.
+var fanOutSend = func(c *CoapServer, req CoapRequest, addr *net.UDPAddr) {
+	go c.SendTo(req, addr)
+}
 
+// fanOutNotification performs the actual per-observer CON/NON send for a
+// resource; it runs both for local NotifyChange calls and for messages
+// arriving on the NotificationBackend from other producers. Observations
+// that haven't been refreshed within their MaxAge are dropped rather than
+// notified.
+func (c *CoapServer) fanOutNotification(resource, value string, confirm bool) {
+	observers, emptied := c.observations.List(resource)
+	if emptied {
+		c.unsubResource(resource)
+	}
+	if len(observers) == 0 {
+		return
+	}
+
+	for _, o := range observers {
+		var req CoapRequest
 		if confirm {
 			req = NewRequest(TYPE_CONFIRMABLE, COAPCODE_205_CONTENT, GenerateMessageId())
 		} else {
 			req = NewRequest(TYPE_ACKNOWLEDGEMENT, COAPCODE_205_CONTENT, GenerateMessageId())
 		}
 
-		for _, r := range t {
-			req.SetToken(r.Token)
-			req.SetStringPayload(value)
-			req.SetRequestURI(r.Resource)
-			r.NotifyCount++
-			req.GetMessage().AddOption(OPTION_OBSERVE, r.NotifyCount)
+		req.SetToken(o.Token)
+		req.SetStringPayload(value)
+		req.SetRequestURI(o.Resource)
+		o.NotifyCount++
+		req.GetMessage().AddOption(OPTION_OBSERVE, o.NotifyCount)
 
-			go c.SendTo(req, r.Addr)
-		}
+		fanOutSend(c, req, o.Addr)
 	}
 }
 
-func (s *CoapServer) addObservation(resource, token string, addr *net.UDPAddr) {
-	s.observations[resource] = append(s.observations[resource], NewObservation(addr, token, resource))
-}
+// sendBlockwise sends respMsg to addr, slicing its payload into a single
+// Block2-sized chunk at the block the client requested (defaulting to block
+// 0 at the server/route's default BlockSize) whenever the full payload
+// doesn't fit in one block, per RFC 7959.
+func (s *CoapServer) sendBlockwise(respMsg *Message, reqMsg *Message, route *Route, conn *net.UDPConn, addr *net.UDPAddr) {
+	payload := respMsg.Payload.GetBytes()
 
-func (s *CoapServer) hasObservation(resource string, addr *net.UDPAddr) bool {
-	obs := s.observations[resource]
-	if obs == nil {
-		return false
+	num := 0
+	szx := szxFromSize(s.blockSizeFor(route))
+	if block2Opt := reqMsg.GetOption(OPTION_BLOCK2); block2Opt != nil {
+		requested := DecodeBlockOption(block2Opt.Value.([]byte))
+		num = requested.Num
+		szx = requested.Szx
 	}
 
-	for _, o := range obs {
-		if o.Addr.String() == addr.String() {
-			return true
-		}
+	if num == 0 && len(payload) <= sizeFromSzx(szx) {
+		s.events.Message(respMsg, false)
+		SendMessageTo(respMsg, NewCanopusUDPConnection(conn), addr)
+		return
+	}
+
+	chunk, more := sliceBlock2(payload, num, szx)
+	respMsg.Payload = NewBytesPayload(chunk)
+	respMsg.AddOption(OPTION_BLOCK2, EncodeBlockOption(BlockOption{Num: num, More: more, Szx: szx}))
+
+	s.events.Message(respMsg, false)
+	SendMessageTo(respMsg, NewCanopusUDPConnection(conn), addr)
+}
+
+// blockSizeFor returns the block-wise transfer size to use for route,
+// falling back from the route's own BlockSize to the server default.
+func (s *CoapServer) blockSizeFor(route *Route) int {
+	if route != nil && route.BlockSize > 0 {
+		return route.BlockSize
+	}
+	if s.BlockSize > 0 {
+		return s.BlockSize
 	}
-	return false
+	return DefaultBlockSize
 }
 
-func (s *CoapServer) removeObservation(resource string, addr *net.UDPAddr) {
-	obs := s.observations[resource]
-	if obs == nil {
-		return
+// routeConfirmable looks up the Confirmable setting of the route serving
+// resource, falling back to fallback if no route matches (e.g. a
+// notification published directly by an external producer on the backend).
+func (s *CoapServer) routeConfirmable(resource string, fallback bool) bool {
+	for _, r := range s.routes {
+		if r.Path == resource {
+			return r.Confirmable
+		}
 	}
+	return fallback
+}
 
-	for idx, o := range obs {
-		if o.Addr.String() == addr.String() {
-			s.observations[resource] = append(obs[:idx], obs[idx+1:]...)
+func (s *CoapServer) addObservation(resource, token string, addr *net.UDPAddr) {
+	wasEmpty := s.observations.Count(resource) == 0
+	s.observations.Add(NewObservation(addr, token, resource))
+
+	if wasEmpty {
+		unsub, err := s.backend.Subscribe(resource, func(payload []byte) {
+			value, confirm := decodeNotifyEnvelope(payload)
+			s.fanOutNotification(resource, value, s.routeConfirmable(resource, confirm))
+		})
+		if err != nil {
+			s.events.Error(err)
 			return
 		}
+		s.observations.SetUnsub(resource, unsub)
+	}
+}
+
+func (s *CoapServer) hasObservation(resource string, addr *net.UDPAddr, token string) bool {
+	return s.observations.Has(resource, addr, token)
+}
+
+func (s *CoapServer) removeObservation(resource string, addr *net.UDPAddr, token string) {
+	s.observations.Remove(resource, addr, token)
+
+	if s.observations.Count(resource) == 0 {
+		s.unsubResource(resource)
+	}
+}
+
+// unsubResource tears down the backend subscription backing resource, if
+// one is currently registered. It is the single place that retires the
+// observationStore's unsub bookkeeping, whether the last observation on
+// resource went away via an explicit cancel (removeObservation) or via
+// MaxAge expiry (List).
+func (s *CoapServer) unsubResource(resource string) {
+	if unsub, ok := s.observations.TakeUnsub(resource); ok {
+		unsub()
 	}
 }
 
@@ -425,6 +646,39 @@ func (c *CoapServer) Dial(host string) {
 	c.remoteAddr = remoteAddr
 }
 
+// DialViaRelay reaches a CoAP endpoint behind NAT through a relay.RelayServer
+// at relayAddr, using the session ID that endpoint registered with the
+// relay. It transparently wraps all further Send/SendTo traffic: outgoing
+// datagrams are framed with the relay's session header and sent to the
+// relay, and anything the relay forwards back arrives over the server's
+// normal read loop exactly as if it came from a directly reachable peer.
+func (c *CoapServer) DialViaRelay(relayAddr string, sessionID string) error {
+	raddr, err := net.ResolveUDPAddr("udp", relayAddr)
+	if err != nil {
+		return err
+	}
+
+	// Forward to the address actually bound, which differs from c.localAddr
+	// when the server was created with a ":0" port.
+	localAddr := c.localAddr
+	if c.localConn != nil {
+		localAddr = c.localConn.LocalAddr().(*net.UDPAddr)
+	}
+
+	dialer, err := relay.Dial(localAddr, raddr, sessionID)
+	if err != nil {
+		return err
+	}
+
+	if c.relayDialer != nil {
+		c.relayDialer.Close()
+	}
+	c.relayDialer = dialer
+	c.remoteAddr = dialer.LocalAddr()
+
+	return nil
+}
+
 func (c *CoapServer) Dial6(host string) {
 	remoteAddr, _ := net.ResolveUDPAddr("udp6", host)
 
@@ -485,20 +739,3 @@ func (s *CoapServer) SetProxy(t ProxyType, enabled bool) {
 		}
 	}
 }
-
-////////////////////////////////////////////////////////////////////////////////
-func NewObservation(addr *net.UDPAddr, token string, resource string) *Observation {
-	return &Observation{
-		Addr:        addr,
-		Token:       token,
-		Resource:    resource,
-		NotifyCount: 0,
-	}
-}
-
-type Observation struct {
-	Addr        *net.UDPAddr
-	Token       string
-	Resource    string
-	NotifyCount int
-}